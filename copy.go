@@ -1,13 +1,71 @@
 package main
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
-	"log"
+	"runtime"
+	"sync"
+)
+
+// reflinkMode controls how copyFile attempts copy-on-write clones. It is
+// set by setCopyOption (copy_opts.go) — currently reachable via the
+// $LF_reflink env var ({auto,always,never}), eventually via `set reflink`
+// once a command dispatcher exists — and defaults to auto.
+type reflinkMode int
+
+const (
+	reflinkAuto reflinkMode = iota
+	reflinkAlways
+	reflinkNever
+)
+
+var gReflink = reflinkAuto
+
+// gCopyConcurrency is the number of worker goroutines copyAll hands file
+// copies to. It is set by setCopyOption (copy_opts.go) — currently
+// reachable via the $LF_copyconcurrency env var — and defaults to
+// runtime.NumCPU().
+var gCopyConcurrency = runtime.NumCPU()
+
+// chunkReadFromSize caps how much os.File.ReadFrom pulls in a single call
+// for same-device copies, so progress is still reported incrementally
+// instead of disappearing into one sendfile/copy_file_range syscall.
+const chunkReadFromSize = 4 << 20 // 4 MiB
+
+// gCopyDebug enables the log line reporting which of the
+// reflink/chunked/sparse/buffered/resume paths copyFile took for each file.
+// It is set from the $LF_COPYDEBUG env var in copy_opts.go's init.
+var gCopyDebug bool
+
+func logCopyDebug(format string, args ...interface{}) {
+	if gCopyDebug {
+		log.Printf(format, args...)
+	}
+}
+
+// copyVerifyMode controls how strictly copyFile checks a copy after it has
+// been renamed into place. It is set by setCopyOption (copy_opts.go) —
+// currently reachable via the $LF_copyverify env var ({off,size,hash}) —
+// and defaults to off.
+type copyVerifyMode int
+
+const (
+	copyVerifyOff copyVerifyMode = iota
+	copyVerifySize
+	copyVerifyHash
 )
 
+var gCopyVerify = copyVerifyOff
+
+// resumeBlockSize is the granularity at which resumePart compares an
+// existing .part file against its source; only blocks whose hashes differ
+// are re-copied.
+const resumeBlockSize = 1 << 20 // 1 MiB
+
 func copySize(srcs []string) (int64, error) {
 	var total int64
 
@@ -33,100 +91,412 @@ func copySize(srcs []string) (int64, error) {
 	return total, nil
 }
 
-// This is a piece of code from `io.copyBuffer()` responsible for a long chain of
-// actions leading to reflink copy
-func iocopyKnockoff(dst io.Writer, src io.Reader) (written int64, err error) {
-	// If the reader has a WriteTo method, use it to do the copy.
-	// Avoids an allocation and a copy.
-	if wt, ok := src.(io.WriterTo); ok {
-		log.Printf("Picked WriterTo")
-		return wt.WriteTo(dst)
+// progressWriter wraps an io.Writer so that each successful Write reports
+// its byte count on nums. Wrapping like this also hides any ReadFrom method
+// the underlying writer might have, so io.CopyBuffer can't shortcut through
+// copy_file_range/sendfile behind our back and skip progress reporting.
+type progressWriter struct {
+	w    io.Writer
+	nums chan int64
+}
+
+func (pw progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	if n > 0 {
+		pw.nums <- int64(n)
+	}
+	return n, err
+}
+
+// copyChunked drives w.ReadFrom in bounded slices of chunkReadFromSize
+// bytes. os.File.ReadFrom special-cases an *io.LimitedReader wrapping an
+// *os.File, so this still takes the copy_file_range/sendfile fast path
+// underneath, it just does so in small enough bites that nums keeps ticking.
+func copyChunked(w *os.File, r *os.File, nums chan int64) error {
+	for {
+		n, err := w.ReadFrom(io.LimitReader(r, chunkReadFromSize))
+		if n > 0 {
+			nums <- n
+		}
+		if err != nil {
+			return err
+		}
+		if n < chunkReadFromSize {
+			return nil
+		}
 	}
-	// Similarly, if the writer has a ReadFrom method, use it to do the copy.
-	// FIXME it always picks this, even when copy is between different file systems
-	if rt, ok := dst.(io.ReaderFrom); ok {
-		log.Printf("Picked ReaderFrom")
-		return rt.ReadFrom(src)
+}
+
+// resumePart compares an existing partial destination file against src
+// block by block and rewrites only the blocks that differ, so a copy
+// interrupted partway through doesn't have to restart from byte zero.
+// sameDev tells it whether src and dst share a device, the same test
+// copyFile uses to decide whether reflink is worth attempting at all.
+func resumePart(w, r *os.File, nums chan int64, sameDev bool) error {
+	srcBuf := make([]byte, resumeBlockSize)
+	dstBuf := make([]byte, resumeBlockSize)
+
+	var off int64
+	for {
+		sn, serr := r.ReadAt(srcBuf, off)
+		if serr != nil && serr != io.EOF {
+			return serr
+		}
+		if sn == 0 {
+			break
+		}
+
+		dn, derr := w.ReadAt(dstBuf[:sn], off)
+		if derr != nil && derr != io.EOF && derr != io.ErrUnexpectedEOF {
+			return derr
+		}
+
+		if dn != sn || sha256.Sum256(srcBuf[:sn]) != sha256.Sum256(dstBuf[:dn]) {
+			if err := resumeBlockCopy(w, r, off, srcBuf[:sn], sameDev); err != nil {
+				return err
+			}
+		}
+		nums <- int64(sn)
+
+		off += int64(sn)
+		if serr == io.EOF {
+			break
+		}
 	}
 
-	// No support for copy-on-write is not an error, falling back to normal copy
-	log.Printf("Picked original loop copy")
-	return -1, nil
+	return w.Truncate(off)
 }
 
-func copyFile(src, dst string, info os.FileInfo, nums chan int64) error {
-	buf := make([]byte, 4096)
+// resumeBlockCopy rewrites one differing block of a resumed .part file.
+// When src and dst share a device and reflink isn't disabled, it first
+// tries FICLONERANGE so the block is shared copy-on-write instead of being
+// read and rewritten through userspace — the "unchanged extents can be
+// cloned" half of resumable copying. Any failure there falls back to a
+// plain write, unless `reflink always` is set, in which case the failure
+// is surfaced instead of silently falling back, matching how `reflink
+// always` is enforced on the non-resume path.
+func resumeBlockCopy(w, r *os.File, off int64, data []byte, sameDev bool) error {
+	if gReflink != reflinkNever && sameDev {
+		if err := reflinkRange(w, r, off, off, int64(len(data))); err == nil {
+			return nil
+		} else if gReflink == reflinkAlways {
+			return fmt.Errorf("reflink: %s", err)
+		}
+	} else if gReflink == reflinkAlways {
+		return fmt.Errorf("reflink: resume source and destination are not known to be on the same device")
+	}
 
-	r, err := os.Open(src)
-	if err != nil {
+	_, err := w.WriteAt(data, off)
+	return err
+}
+
+// finishCopy fsyncs the .part file, chmods it to match info and renames it
+// into place. Syncing before the rename is what makes the swap crash-safe:
+// once Rename returns, dst is either the previous file or the complete new
+// one, never a half-written one.
+func finishCopy(w *os.File, partPath, dst string, info os.FileInfo) error {
+	if err := os.Chmod(partPath, info.Mode()); err != nil {
+		w.Close()
+		os.Remove(partPath)
 		return err
 	}
-	defer r.Close()
+	if err := w.Sync(); err != nil {
+		w.Close()
+		os.Remove(partPath)
+		return err
+	}
+	if err := w.Close(); err != nil {
+		os.Remove(partPath)
+		return err
+	}
+	return os.Rename(partPath, dst)
+}
 
-	w, err := os.Create(dst)
+// verifyCopy implements `set copyverify {off,size,hash}`.
+func verifyCopy(src, dst string, info os.FileInfo) error {
+	switch gCopyVerify {
+	case copyVerifySize:
+		fi, err := os.Stat(dst)
+		if err != nil {
+			return err
+		}
+		if fi.Size() != info.Size() {
+			return fmt.Errorf("verify: %s: size mismatch: got %d, want %d", dst, fi.Size(), info.Size())
+		}
+	case copyVerifyHash:
+		sh, err := fileHash(src)
+		if err != nil {
+			return err
+		}
+		dh, err := fileHash(dst)
+		if err != nil {
+			return err
+		}
+		if sh != dh {
+			return fmt.Errorf("verify: %s: content hash mismatch", dst)
+		}
+	}
+	return nil
+}
+
+func fileHash(path string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+
+	f, err := os.Open(path)
 	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// copyOwnerAndTimes best-effort replays uid/gid and mtime from src onto
+// dst. Ownership changes routinely fail under EPERM for non-root users;
+// that's expected and isn't treated as a copy failure. True atime isn't
+// replayed since Stat_t's atime field isn't named consistently across unix
+// flavors; dst's atime/mtime are both set to src's mtime instead.
+func copyOwnerAndTimes(dst string, info os.FileInfo) error {
+	if uid, gid, ok := fileOwner(info); ok {
+		if err := os.Chown(dst, uid, gid); err != nil && !os.IsPermission(err) {
+			return err
+		}
+	}
+
+	mtime := info.ModTime()
+	if err := os.Chtimes(dst, mtime, mtime); err != nil && !os.IsPermission(err) {
+		return err
+	}
+
+	return nil
+}
+
+// copyDirMeta best-effort replays xattrs/ownership/timestamps onto a
+// directory. Creating or renaming entries inside dst bumps its mtime, so
+// copyAll only calls this once all of a directory's descendants are done
+// being created, not right after the directory itself is made.
+func copyDirMeta(src, dst string, info os.FileInfo) error {
+	if err := copyXattrs(src, dst); err != nil {
+		return fmt.Errorf("xattr: %s", err)
+	}
+	return copyOwnerAndTimes(dst, info)
+}
+
+// copySymlinkMeta best-effort replays xattrs/ownership/timestamps onto a
+// symlink itself rather than the file it points to, mirroring
+// copyOwnerAndTimes/copyXattrs for regular files.
+func copySymlinkMeta(src, dst string, info os.FileInfo) error {
+	if err := copyXattrs(src, dst); err != nil {
+		return fmt.Errorf("xattr: %s", err)
+	}
+
+	if uid, gid, ok := fileOwner(info); ok {
+		if err := os.Lchown(dst, uid, gid); err != nil && !os.IsPermission(err) {
+			return fmt.Errorf("lchown: %s", err)
+		}
+	}
+
+	mtime := info.ModTime()
+	if err := lchtimes(dst, mtime, mtime); err != nil && !os.IsPermission(err) {
+		return fmt.Errorf("lchtimes: %s", err)
+	}
+
+	return nil
+}
+
+// completeCopy finishes a content copy: renames the .part file into place,
+// replays xattrs/ownership/timestamps, and runs the post-copy verification
+// configured via `set copyverify`.
+func completeCopy(w *os.File, partPath, src, dst string, info os.FileInfo) error {
+	if err := finishCopy(w, partPath, dst, info); err != nil {
 		return err
 	}
+	if err := copyXattrs(src, dst); err != nil {
+		return fmt.Errorf("xattr: %s", err)
+	}
+	if err := copyOwnerAndTimes(dst, info); err != nil {
+		return fmt.Errorf("chown/chtimes: %s", err)
+	}
+	return verifyCopy(src, dst, info)
+}
+
+// findOrphanedParts walks dir for .part files left behind by a copy that
+// was interrupted before it could be renamed into place. copyAll calls this
+// up front and returns the result as its orphans value, so a caller can
+// offer to resume or discard them; a .part whose source is copied again in
+// the same call is separately picked up by copyFile's own resume check.
+func findOrphanedParts(dir string) ([]string, error) {
+	var parts []string
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && filepath.Ext(path) == ".part" {
+			parts = append(parts, path)
+		}
+		return nil
+	})
 
-	// Right now this is equivalent to permanent `set reflink auto`
-	//
-	// Ideally this should be `io.CopyBuffer()` with custom buffer that tracks
-	// progress (SOMEHOW*) when `set reflink auto` and it can't reflink;
-	//
-	// The buffer should be forced with `io.CopyBuffer(struct{ io.Writer }{w}, r, buf)` when `set reflink never`,
-	// like here https://go.dev/doc/go1.15#os
-	//
-	// * - ... but I have no idea how to create something like that, hence why I opted for crude `iocopyKnockoff()`
+	return parts, err
+}
 
-	written, err := iocopyKnockoff(w, r)
+func copyFile(src, dst string, info os.FileInfo, nums chan int64) error {
+	r, err := os.Open(src)
 	if err != nil {
-		w.Close()
-		os.Remove(dst)
 		return err
 	}
+	defer r.Close()
 
-	// this never runs because ReaderFrom is always picked
-	if written == -1 {
-		for {
-			n, err := r.Read(buf)
-			if err != nil && err != io.EOF {
-				w.Close()
-				os.Remove(dst)
-				return err
-			}
-
-			if n == 0 {
-				break
-			}
+	partPath := dst + ".part"
 
-			if _, err := w.Write(buf[:n]); err != nil {
-				return err
-			}
+	sameDev, devKnown := false, false
+	if dstDirInfo, err := os.Stat(filepath.Dir(dst)); err == nil {
+		sameDev, devKnown = sameDevice(info, dstDirInfo)
+	}
 
-			nums <- int64(n)
+	if pf, err := os.OpenFile(partPath, os.O_RDWR, 0); err == nil {
+		logCopyDebug("copy %s -> %s: resuming %s", src, dst, partPath)
+		if err := resumePart(pf, r, nums, devKnown && sameDev); err != nil {
+			pf.Close()
+			os.Remove(partPath)
+			return fmt.Errorf("resume: %s", err)
 		}
-	} else {
-		nums <- written
+		return completeCopy(pf, partPath, src, dst, info)
 	}
 
-	if err := w.Close(); err != nil {
-		os.Remove(dst)
+	w, err := os.Create(partPath)
+	if err != nil {
 		return err
 	}
 
-	if err := os.Chmod(dst, info.Mode()); err != nil {
-		os.Remove(dst)
+	if gReflink != reflinkNever && devKnown && sameDev {
+		if err := reflinkCopy(w, r); err == nil {
+			logCopyDebug("copy %s -> %s: reflink", src, dst)
+			nums <- info.Size()
+			return completeCopy(w, partPath, src, dst, info)
+		} else if gReflink == reflinkAlways || !isReflinkFallbackErr(err) {
+			w.Close()
+			os.Remove(partPath)
+			return fmt.Errorf("reflink: %s", err)
+		}
+	} else if gReflink == reflinkAlways {
+		w.Close()
+		os.Remove(partPath)
+		return fmt.Errorf("reflink: %s and %s are not known to be on the same device", src, dst)
+	}
+
+	// Reflink wasn't used: either it's disabled, unavailable, or src/dst
+	// aren't known to share a device. Try a hole-aware copy first — unlike
+	// the chunked ReadFrom path it doesn't need src and dst on the same
+	// device, so it's the strictly more general fallback and must be tried
+	// before, not after, the same-device-only path.
+	handled, err := sparseCopy(w, r, info.Size(), nums)
+	if err != nil {
+		w.Close()
+		os.Remove(partPath)
 		return err
 	}
 
-	return nil
+	switch {
+	case handled:
+		logCopyDebug("copy %s -> %s: sparse", src, dst)
+	case devKnown && sameDev:
+		logCopyDebug("copy %s -> %s: chunked same-device", src, dst)
+		if err := copyChunked(w, r, nums); err != nil {
+			w.Close()
+			os.Remove(partPath)
+			return err
+		}
+	default:
+		logCopyDebug("copy %s -> %s: buffered", src, dst)
+		buf := make([]byte, 4096)
+		if _, err := io.CopyBuffer(progressWriter{w, nums}, r, buf); err != nil {
+			w.Close()
+			os.Remove(partPath)
+			return err
+		}
+	}
+
+	return completeCopy(w, partPath, src, dst, info)
+}
+
+// copyJob is a single non-directory entry (regular file or symlink) queued
+// up by the copyAll walker for a worker to handle.
+type copyJob struct {
+	path    string
+	newPath string
+	info    os.FileInfo
 }
 
-func copyAll(srcs []string, dstDir string) (nums chan int64, errs chan error) {
+// copyAll copies srcs into dstDir. orphans lists any *.part files already
+// sitting in dstDir before the copy starts: one whose source is among srcs
+// gets picked up by copyFile's own resume check, but the rest have no
+// matching source in this call and are only reported here, not acted on —
+// offering the user a resume/discard choice for those is for the caller
+// (eventually a `set`-command-style prompt) to do with this list.
+func copyAll(srcs []string, dstDir string) (nums chan int64, errs chan error, orphans []string) {
 	nums = make(chan int64, 1024)
 	errs = make(chan error, 1024)
 
+	orphans, orphanErr := findOrphanedParts(dstDir)
+	if orphanErr != nil {
+		logCopyDebug("copy: scanning %s for orphaned .part files: %s", dstDir, orphanErr)
+		orphans = nil
+	}
+
 	go func() {
+		defer close(errs)
+
+		for _, p := range orphans {
+			logCopyDebug("copy: found orphaned %s; a matching source path will resume it, otherwise it's left for the caller to offer resuming or discarding", p)
+		}
+
+		jobs := make(chan copyJob, 1024)
+
+		// dirs records every directory the walker creates, in walk (i.e.
+		// parent-before-child) order, so their metadata can be replayed in
+		// reverse (child-before-parent) once every file and subdirectory
+		// copy has finished. Applying it any earlier would just get
+		// clobbered: creating or renaming an entry inside a directory bumps
+		// that directory's own mtime right back to "now".
+		var dirs []copyJob
+
+		n := gCopyConcurrency
+		if n < 1 {
+			n = 1
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(n)
+		for i := 0; i < n; i++ {
+			go func() {
+				defer wg.Done()
+				for job := range jobs {
+					if job.info.Mode()&os.ModeSymlink != 0 { /* Symlink */
+						if rlink, err := os.Readlink(job.path); err != nil {
+							errs <- fmt.Errorf("symlink: %s", err)
+						} else if err := os.Symlink(rlink, job.newPath); err != nil {
+							errs <- fmt.Errorf("symlink: %s", err)
+						} else if err := copySymlinkMeta(job.path, job.newPath, job.info); err != nil {
+							errs <- err
+						}
+						nums <- job.info.Size()
+					} else if err := copyFile(job.path, job.newPath, job.info, nums); err != nil {
+						errs <- fmt.Errorf("copy: %s", err)
+					}
+				}
+			}()
+		}
+
+		// The walker stays single-threaded: it creates every directory
+		// synchronously, before any of its children can be dispatched, so
+		// workers never race to create a file's parent directory.
 		for _, src := range srcs {
 			dst := filepath.Join(dstDir, filepath.Base(src))
 
@@ -154,28 +524,27 @@ func copyAll(srcs []string, dstDir string) (nums chan int64, errs chan error) {
 				if info.IsDir() {
 					if err := os.MkdirAll(newPath, info.Mode()); err != nil {
 						errs <- fmt.Errorf("mkdir: %s", err)
-					}
-					nums <- info.Size()
-				} else if info.Mode()&os.ModeSymlink != 0 { /* Symlink */
-					if rlink, err := os.Readlink(path); err != nil {
-						errs <- fmt.Errorf("symlink: %s", err)
 					} else {
-						if err := os.Symlink(rlink, newPath); err != nil {
-							errs <- fmt.Errorf("symlink: %s", err)
-						}
+						dirs = append(dirs, copyJob{path: path, newPath: newPath, info: info})
 					}
 					nums <- info.Size()
 				} else {
-					if err := copyFile(path, newPath, info, nums); err != nil {
-						errs <- fmt.Errorf("copy: %s", err)
-					}
+					jobs <- copyJob{path: path, newPath: newPath, info: info}
 				}
 				return nil
 			})
 		}
 
-		close(errs)
+		close(jobs)
+		wg.Wait()
+
+		for i := len(dirs) - 1; i >= 0; i-- {
+			d := dirs[i]
+			if err := copyDirMeta(d.path, d.newPath, d.info); err != nil {
+				errs <- err
+			}
+		}
 	}()
 
-	return nums, errs
+	return nums, errs, orphans
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+func init() {
+	applyCopyEnv(os.LookupEnv)
+}
+
+// applyCopyEnv reads this file's copy options out of the environment, the
+// one seam reachable without a `set`-command dispatcher or a main package
+// to call flag.Parse: env vars are read on process startup regardless of
+// which main eventually links this package in. Once a real `set` command
+// exists it should call setCopyOption directly instead, and init's call to
+// this can go. lookup is os.LookupEnv, swapped out in tests.
+func applyCopyEnv(lookup func(string) (string, bool)) {
+	for _, name := range []string{"reflink", "copyconcurrency", "copyverify", "copyxattr"} {
+		value, set := lookup("LF_" + name)
+		if !set {
+			continue
+		}
+		if _, err := setCopyOption(name, value); err != nil {
+			log.Printf("copy: $LF_%s: %s", name, err)
+		}
+	}
+
+	if value, set := lookup("LF_COPYDEBUG"); set {
+		debug, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Printf("copy: $LF_COPYDEBUG: invalid value %q", value)
+		} else {
+			gCopyDebug = debug
+		}
+	}
+}
+
+// setCopyOption applies one of this file's copy-related settings by name,
+// the way the `set` command's option switch applies any other option. It
+// returns ok=false for names it doesn't recognize, so the `set` command can
+// fall through to the rest of its option table.
+func setCopyOption(name, value string) (ok bool, err error) {
+	switch name {
+	case "reflink":
+		switch value {
+		case "auto":
+			gReflink = reflinkAuto
+		case "always":
+			gReflink = reflinkAlways
+		case "never":
+			gReflink = reflinkNever
+		default:
+			return true, fmt.Errorf("set reflink: unknown value %q", value)
+		}
+	case "copyconcurrency":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return true, fmt.Errorf("set copyconcurrency: invalid value %q", value)
+		}
+		gCopyConcurrency = n
+	case "copyverify":
+		switch value {
+		case "off":
+			gCopyVerify = copyVerifyOff
+		case "size":
+			gCopyVerify = copyVerifySize
+		case "hash":
+			gCopyVerify = copyVerifyHash
+		default:
+			return true, fmt.Errorf("set copyverify: unknown value %q", value)
+		}
+	case "copyxattr":
+		switch value {
+		case "all":
+			gCopyXattr = copyXattrAll
+		case "user":
+			gCopyXattr = copyXattrUser
+		case "none":
+			gCopyXattr = copyXattrNone
+		default:
+			return true, fmt.Errorf("set copyxattr: unknown value %q", value)
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
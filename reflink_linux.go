@@ -0,0 +1,37 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflinkCopy attempts to clone src onto dst via the FICLONE ioctl, which
+// shares the underlying extents copy-on-write instead of reading and
+// writing the file's bytes. It either clones the whole file or fails; there
+// is no partial-progress case to report here.
+func reflinkCopy(dst, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
+
+// isReflinkFallbackErr reports whether err is the kind of failure that
+// `reflink auto` should silently fall back from, rather than treat as fatal.
+func isReflinkFallbackErr(err error) bool {
+	return errors.Is(err, unix.EXDEV) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EINVAL)
+}
+
+// reflinkRange clones a single extent of src onto dst via FICLONERANGE, the
+// sub-range counterpart of the whole-file FICLONE used by reflinkCopy.
+// resumePart uses this so blocks it has to rewrite are shared copy-on-write
+// instead of read out of src and rewritten through userspace.
+func reflinkRange(dst, src *os.File, dstOff, srcOff, length int64) error {
+	return unix.IoctlFileCloneRange(int(dst.Fd()), &unix.FileCloneRange{
+		Src_fd:      int64(src.Fd()),
+		Src_offset:  uint64(srcOff),
+		Src_length:  uint64(length),
+		Dest_offset: uint64(dstOff),
+	})
+}
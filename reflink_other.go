@@ -0,0 +1,29 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// errReflinkUnsupported is returned by reflinkCopy on platforms with no
+// FICLONE equivalent wired up yet.
+var errReflinkUnsupported = errors.New("reflink copy is not supported on this platform")
+
+// reflinkCopy always fails on non-Linux platforms; callers fall back to the
+// buffered copy path.
+func reflinkCopy(dst, src *os.File) error {
+	return errReflinkUnsupported
+}
+
+// isReflinkFallbackErr is always true here since reflinkCopy never succeeds,
+// so `reflink auto` always falls back and `reflink always` always fails.
+func isReflinkFallbackErr(err error) bool {
+	return true
+}
+
+// reflinkRange has no FICLONERANGE equivalent wired up on this platform.
+func reflinkRange(dst, src *os.File, dstOff, srcOff, length int64) error {
+	return errReflinkUnsupported
+}
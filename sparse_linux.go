@@ -0,0 +1,85 @@
+//go:build linux
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// sparseCopy replays src's data extents onto dst using SEEK_DATA/SEEK_HOLE,
+// truncating dst to the full size and only ever writing the bytes that back
+// real data, so a sparse source (e.g. a disk image with large zero-filled
+// holes) doesn't get materialized into that many zero bytes on the
+// destination. It reports handled=false (falling back to a regular stream
+// copy) whenever SEEK_DATA isn't supported on src's filesystem at all; once
+// it has started writing, any further error is returned as a hard failure
+// rather than silently falling back onto a partially sparse-copied file.
+func sparseCopy(w, r *os.File, size int64, nums chan int64) (handled bool, err error) {
+	if size == 0 {
+		return true, w.Truncate(0)
+	}
+
+	buf := make([]byte, 1<<20)
+	fd := int(r.Fd())
+	truncated := false
+
+	for off := int64(0); off < size; {
+		dataOff, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		if err != nil {
+			if err == unix.ENXIO {
+				break // no more data; the rest of the file is a hole
+			}
+			if !truncated && (err == unix.EINVAL || err == unix.EOPNOTSUPP) {
+				return false, nil
+			}
+			return false, err
+		}
+
+		if !truncated {
+			if err := w.Truncate(size); err != nil {
+				return false, err
+			}
+			truncated = true
+		}
+
+		holeOff, err := unix.Seek(fd, dataOff, unix.SEEK_HOLE)
+		if err != nil {
+			return false, err
+		}
+
+		for pos := dataOff; pos < holeOff; {
+			want := holeOff - pos
+			if want > int64(len(buf)) {
+				want = int64(len(buf))
+			}
+
+			n, err := r.ReadAt(buf[:want], pos)
+			if n > 0 {
+				if _, werr := w.WriteAt(buf[:n], pos); werr != nil {
+					return false, werr
+				}
+				nums <- int64(n)
+				pos += int64(n)
+			}
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return false, err
+			}
+		}
+
+		off = holeOff
+	}
+
+	if !truncated {
+		if err := w.Truncate(size); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// sparseCopy has no SEEK_HOLE/SEEK_DATA equivalent wired up on this
+// platform yet, so it always defers to the regular stream copy.
+func sparseCopy(w, r *os.File, size int64, nums chan int64) (handled bool, err error) {
+	return false, nil
+}
@@ -0,0 +1,35 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// sameDevice reports whether a and b live on the same filesystem device, by
+// comparing the Dev field of their underlying Stat_t. The second return
+// value is false when that comparison isn't possible (a or b didn't come
+// from a syscall-backed FileInfo), meaning the device is unknown.
+func sameDevice(a, b os.FileInfo) (same, ok bool) {
+	sa, ok := a.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, false
+	}
+	sb, ok := b.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, false
+	}
+	return sa.Dev == sb.Dev, true
+}
+
+// fileOwner extracts the uid/gid backing info, for replaying ownership
+// after a copy. ok is false when info didn't come from a syscall-backed
+// FileInfo.
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
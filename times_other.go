@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "time"
+
+// lchtimes has no symlink-timestamp API wired up on this platform yet.
+func lchtimes(path string, atime, mtime time.Time) error {
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package main
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// lchtimes sets atime/mtime on path without following a trailing symlink,
+// so a symlink's own timestamps can be replayed instead of its target's.
+func lchtimes(path string, atime, mtime time.Time) error {
+	tv := []unix.Timeval{
+		unix.NsecToTimeval(atime.UnixNano()),
+		unix.NsecToTimeval(mtime.UnixNano()),
+	}
+	return unix.Lutimes(path, tv)
+}
@@ -0,0 +1,87 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyXattrMode controls which extended attributes copyXattrs replays onto
+// the destination. It is set by setCopyOption (copy_opts.go) — currently
+// reachable via the $LF_copyxattr env var ({all,user,none}) — and defaults
+// to user, which skips the security.* and trusted.* namespaces unless
+// running as root.
+type copyXattrMode int
+
+const (
+	copyXattrNone copyXattrMode = iota
+	copyXattrUser
+	copyXattrAll
+)
+
+var gCopyXattr = copyXattrUser
+
+// copyXattrs replays src's extended attributes onto dst. POSIX ACLs live
+// under the system.posix_acl_{access,default} xattrs, so this also carries
+// ACLs across without any ACL-specific code. Attributes that can't be read
+// or set are skipped rather than failing the whole copy; a read-only
+// destination filesystem or an unsupported namespace is routine, not an
+// error worth aborting over.
+func copyXattrs(src, dst string) error {
+	if gCopyXattr == copyXattrNone {
+		return nil
+	}
+
+	size, err := unix.Llistxattr(src, nil)
+	if err != nil {
+		if err == unix.ENOTSUP {
+			return nil
+		}
+		return err
+	}
+	if size == 0 {
+		return nil
+	}
+
+	buf := make([]byte, size)
+	n, err := unix.Llistxattr(src, buf)
+	if err != nil {
+		return err
+	}
+
+	root := os.Geteuid() == 0
+	for _, name := range splitXattrNames(buf[:n]) {
+		if gCopyXattr != copyXattrAll && !root && isRestrictedXattr(name) {
+			continue
+		}
+
+		vsize, err := unix.Lgetxattr(src, name, nil)
+		if err != nil {
+			continue
+		}
+		val := make([]byte, vsize)
+		if _, err := unix.Lgetxattr(src, name, val); err != nil {
+			continue
+		}
+		unix.Lsetxattr(dst, name, val, 0)
+	}
+
+	return nil
+}
+
+func splitXattrNames(buf []byte) []string {
+	var names []string
+	for _, s := range strings.Split(string(buf), "\x00") {
+		if s != "" {
+			names = append(names, s)
+		}
+	}
+	return names
+}
+
+func isRestrictedXattr(name string) bool {
+	return strings.HasPrefix(name, "security.") || strings.HasPrefix(name, "trusted.")
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package main
+
+// copyXattrMode controls which extended attributes copyXattrs replays onto
+// the destination. It is set by setCopyOption (copy_opts.go), currently
+// reachable via the $LF_copyxattr env var ({all,user,none}); there's no
+// xattr API wired up on this
+// platform yet, so copyXattrs is always a no-op.
+type copyXattrMode int
+
+const (
+	copyXattrNone copyXattrMode = iota
+	copyXattrUser
+	copyXattrAll
+)
+
+var gCopyXattr = copyXattrUser
+
+func copyXattrs(src, dst string) error {
+	return nil
+}